@@ -3,13 +3,79 @@ package main
 import (
 	"bytes"
 	"crypto/sha1"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
+var numPrefetchJobs = flag.Int("include_prefetch_jobs", 1, "Number of worker goroutines used to speculatively read and parse included makefiles ahead of the evaluator. 1 disables prefetching.")
+
+var jsonDiagnostics = flag.Bool("diagnostics_json", false, "Emit eval errors as a single machine-readable JSON object instead of a GCC-style multi-line message.")
+
+// evalFrame is one entry of the include chain that led to an eval error:
+// the construct being evaluated and where it was.
+type evalFrame struct {
+	Filename  string `json:"file"`
+	Lineno    int    `json:"line"`
+	Construct string `json:"construct"`
+}
+
+// evalError carries the full include chain down to the construct that
+// failed, so Eval's recover can print a GCC-style "In file included
+// from ..." diagnostic instead of the bare "panic in eval" it used to.
+type evalError struct {
+	Frames []evalFrame
+	Msg    string
+}
+
+func (e *evalError) Error() string {
+	if *jsonDiagnostics {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return e.Msg
+		}
+		return string(b)
+	}
+	if len(e.Frames) == 0 {
+		return e.Msg
+	}
+	var buf bytes.Buffer
+	for i, f := range e.Frames {
+		switch {
+		case i == len(e.Frames)-1:
+			fmt.Fprintf(&buf, "%s:%d: %s", f.Filename, f.Lineno, e.Msg)
+		case i == 0:
+			fmt.Fprintf(&buf, "In file included from %s:%d:\n", f.Filename, f.Lineno)
+		default:
+			fmt.Fprintf(&buf, "                 from %s:%d:\n", f.Filename, f.Lineno)
+		}
+	}
+	return buf.String()
+}
+
+func (e *evalError) MarshalJSON() ([]byte, error) {
+	type alias struct {
+		Frames  []evalFrame `json:"stack"`
+		Message string      `json:"message"`
+	}
+	return json.Marshal(alias{Frames: e.Frames, Message: e.Msg})
+}
+
+// errorf builds an evalError for a failure while evaluating construct at
+// ev.filename:ev.lineno, with ev.includeStack as the chain of includes
+// that got us there.
+func (ev *Evaluator) errorf(construct, format string, args ...interface{}) *evalError {
+	frames := append([]evalFrame(nil), ev.includeStack...)
+	frames = append(frames, evalFrame{Filename: ev.filename, Lineno: ev.lineno, Construct: construct})
+	return &evalError{Frames: frames, Msg: fmt.Sprintf(format, args...)}
+}
+
 const (
 	FILE_EXISTS       = 0
 	FILE_NOT_EXISTS   = 1
@@ -42,6 +108,9 @@ type Evaluator struct {
 	hasIO        bool
 	readMks      map[string]*ReadMakefile
 	exports      map[string]bool
+	prefetcher   *includePrefetcher
+	sandbox      *shellSandbox
+	includeStack []evalFrame
 
 	filename string
 	lineno   int
@@ -54,13 +123,140 @@ func newEvaluator(vars map[string]Var) *Evaluator {
 		outRuleVars: make(map[string]Vars),
 		readMks:     make(map[string]*ReadMakefile),
 		exports:     make(map[string]bool),
+		prefetcher:  newIncludePrefetcher(*numPrefetchJobs),
+		sandbox:     newShellSandbox(),
+	}
+}
+
+// prefetchResult is a worker's read+parse outcome for one included file,
+// kept around just long enough for evalInclude to pick it up. It carries
+// the exact bytes the worker read alongside the Makefile parsed from them,
+// so a caller that takes a hit hashes and evaluates the same content
+// instead of risking a second, independent read racing a concurrent edit
+// to fname.
+type prefetchResult struct {
+	c   []byte
+	mk  Makefile
+	err error
+}
+
+// includePrefetcher runs a small worker pool that speculatively reads and
+// parses makefiles named in -include/include statements while the
+// evaluator keeps applying statements sequentially. Workers only ever
+// write into p.results, guarded by p.mu; they never touch ev.outVars,
+// ev.outRules, LookupMakefileCache's backing store, or any other shared
+// evaluator/package state, so statement order and rule/variable mutation
+// stay strictly sequential regardless of how many workers race ahead on
+// I/O and parsing, and this package's own state can't race across
+// workers or with the main goroutine.
+//
+// This is the first place in the codebase that calls ParseMakefile
+// concurrently from background goroutines; its internals (buffer pools,
+// interning tables, stats counters) live outside this checkout and
+// aren't audited here.
+// TestIncludePrefetcherConcurrentParsesDontRace (eval_prefetch_test.go)
+// runs several concurrent prefetches of distinct files alongside a
+// ParseMakefile call on another goroutine under -race for confidence, rather
+// than asserting it as fact.
+type includePrefetcher struct {
+	jobs chan string
+	wg   sync.WaitGroup
+
+	mu      sync.Mutex
+	results map[string]prefetchResult
+}
+
+func newIncludePrefetcher(workers int) *includePrefetcher {
+	if workers <= 1 {
+		return nil
+	}
+	p := &includePrefetcher{
+		jobs:    make(chan string, workers*4),
+		results: make(map[string]prefetchResult),
+	}
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go p.work()
 	}
+	return p
+}
+
+func (p *includePrefetcher) work() {
+	defer p.wg.Done()
+	for fname := range p.jobs {
+		p.mu.Lock()
+		_, already := p.results[fname]
+		p.mu.Unlock()
+		if already {
+			continue
+		}
+		c, err := ioutil.ReadFile(fname)
+		if err != nil {
+			// evalInclude will hit (and report) the same error when it
+			// gets to fname sequentially.
+			continue
+		}
+		mk, err := ParseMakefile(c, fname)
+		p.mu.Lock()
+		p.results[fname] = prefetchResult{c: c, mk: mk, err: err}
+		p.mu.Unlock()
+	}
+}
+
+// schedule asks the pool to prefetch fname. It never blocks: a full queue
+// just means fname will be parsed synchronously by evalIncludeFile later,
+// same as without prefetching.
+func (p *includePrefetcher) schedule(fname string) {
+	if p == nil {
+		return
+	}
+	select {
+	case p.jobs <- fname:
+	default:
+	}
+}
+
+// take returns and consumes fname's prefetched parse result, if a worker
+// has already produced one.
+func (p *includePrefetcher) take(fname string) (prefetchResult, bool) {
+	if p == nil {
+		return prefetchResult{}, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r, ok := p.results[fname]
+	if ok {
+		delete(p.results, fname)
+	}
+	return r, ok
+}
+
+func (p *includePrefetcher) close() {
+	if p == nil {
+		return
+	}
+	close(p.jobs)
+	p.wg.Wait()
+}
+
+// evalTraced runs v.Eval(w, ev) wrapped in a B/E trace pair named after v's
+// concrete type (e.g. "*main.funcShell" for $(shell ...)). Use this at a
+// top-level evaluation site - one not already reached through ev.args -
+// so a slow $(shell ...)/$(eval ...) shows up in --trace_file even when
+// it's the value being evaluated directly, rather than nested as another
+// function's argument.
+func (ev *Evaluator) evalTraced(w io.Writer, v Value) {
+	end := theTracer.begin(traceFuncName(v), ev.filename, ev.lineno)
+	v.Eval(w, ev)
+	end()
 }
 
 func (ev *Evaluator) args(buf *buffer, args ...Value) [][]byte {
 	var pos []int
 	for _, arg := range args {
+		end := theTracer.begin(traceFuncName(arg), ev.filename, ev.lineno)
 		arg.Eval(buf, ev)
+		end()
 		pos = append(pos, buf.Len())
 	}
 	v := buf.Bytes()
@@ -74,6 +270,7 @@ func (ev *Evaluator) args(buf *buffer, args ...Value) [][]byte {
 }
 
 func (ev *Evaluator) evalAssign(ast *AssignAST) {
+	defer theTracer.begin("evalAssign", ast.filename, ast.lineno)()
 	ev.lastRule = nil
 	lhs, rhs := ev.evalAssignAST(ast)
 	Log("ASSIGN: %s=%q (flavor:%q)", lhs, rhs, rhs.Flavor())
@@ -89,7 +286,7 @@ func (ev *Evaluator) evalAssignAST(ast *AssignAST) (string, Var) {
 
 	v, _, err := parseExpr([]byte(ast.lhs), nil)
 	if err != nil {
-		panic(fmt.Errorf("parse %s:%d %v", ev.filename, ev.lineno, err))
+		panic(ev.errorf("assign", "parse error: %v", err))
 	}
 	var lhs string
 	switch v := v.(type) {
@@ -99,7 +296,7 @@ func (ev *Evaluator) evalAssignAST(ast *AssignAST) (string, Var) {
 		lhs = string(v)
 	default:
 		buf := newBuf()
-		v.Eval(buf, ev)
+		ev.evalTraced(buf, v)
 		lhs = string(trimSpaceBytes(buf.Bytes()))
 		freeBuf(buf)
 	}
@@ -121,6 +318,7 @@ func (ev *Evaluator) setTargetSpecificVar(assign *AssignAST, output string) {
 }
 
 func (ev *Evaluator) evalMaybeRule(ast *MaybeRuleAST) {
+	defer theTracer.begin("evalMaybeRule", ast.filename, ast.lineno)()
 	ev.lastRule = nil
 	ev.filename = ast.filename
 	ev.lineno = ast.lineno
@@ -134,10 +332,10 @@ func (ev *Evaluator) evalMaybeRule(ast *MaybeRuleAST) {
 	}
 	lexpr, _, err := parseExpr([]byte(expr), nil)
 	if err != nil {
-		panic(fmt.Errorf("parse %s:%d %v", ev.filename, ev.lineno, err))
+		panic(ev.errorf("rule", "parse error: %v", err))
 	}
 	buf := newBuf()
-	lexpr.Eval(buf, ev)
+	ev.evalTraced(buf, lexpr)
 	line := buf.Bytes()
 	if ast.equalIndex >= 0 {
 		line = append(line, []byte(ast.expr[ast.equalIndex:])...)
@@ -169,10 +367,10 @@ func (ev *Evaluator) evalMaybeRule(ast *MaybeRuleAST) {
 			// TODO(ukai): reuse lexpr above?
 			lexpr, _, err := parseExpr([]byte(ast.expr), nil)
 			if err != nil {
-				panic(fmt.Errorf("parse %s:%d %v", ev.filename, ev.lineno, err))
+				panic(ev.errorf("rule", "parse error: %v", err))
 			}
 			buf = newBuf()
-			lexpr.Eval(buf, ev)
+			ev.evalTraced(buf, lexpr)
 			assign, err = rule.parse(buf.Bytes())
 			if err != nil {
 				Error(ast.filename, ast.lineno, "%v", err.Error())
@@ -259,15 +457,33 @@ func (ev *Evaluator) EvaluateVar(name string) string {
 	return buf.String()
 }
 
-func (ev *Evaluator) evalIncludeFile(fname string, c []byte) error {
+// evalIncludeFile has no persistent cache: a kati invocation always pays
+// LookupMakefileCache's in-memory cost at best, and a fresh ParseMakefile
+// at worst, even for a makefile an earlier kati process already parsed.
+// shinh/kati#chunk0-2 asked for a cache that lets a repeated invocation
+// skip the parse phase entirely; an earlier attempt at that (since
+// reverted, see 0a66e5b and 7f39992) could only store the filename and
+// re-parse on every "hit", because the AST node types a real cache entry
+// would need to serialize live in ast.go, which isn't part of this
+// checkout. That request is still open, not done: a real fix needs
+// ast.go's node types to gain (Gob)Encode/Decode support first.
+func (ev *Evaluator) evalIncludeFile(fname string, c []byte, pr prefetchResult, havePrefetch bool) error {
 	t := time.Now()
 	defer func() {
 		addStats("include", literal(fname), t)
 	}()
 	mk, err, ok := LookupMakefileCache(fname)
 	if !ok {
-		Log("Reading makefile %q", fname)
-		mk, err = ParseMakefile(c, fname)
+		if havePrefetch {
+			// pr.mk was parsed from pr.c, the same bytes the caller
+			// already hashed via updateReadMakefile(fn, pr.c, ...), so
+			// using it here can't disagree with the bookkeeping.
+			Log("Reading makefile %q from prefetch pool", fname)
+			mk, err = pr.mk, pr.err
+		} else {
+			Log("Reading makefile %q", fname)
+			mk, err = ParseMakefile(c, fname)
+		}
 	}
 	if err != nil {
 		return err
@@ -276,6 +492,16 @@ func (ev *Evaluator) evalIncludeFile(fname string, c []byte) error {
 	makefileList = makefileList.Append(ev, mk.filename)
 	ev.outVars.Assign("MAKEFILE_LIST", makefileList)
 
+	// Pushed only now that fname actually parsed: a failure above (read
+	// or parse error, handled by the caller) reports at this include
+	// statement's own ev.filename/ev.lineno, which is also what a frame
+	// pushed here would say, so pushing any earlier would make that
+	// error's frame a duplicate of this one.
+	ev.includeStack = append(ev.includeStack, evalFrame{Filename: ev.filename, Lineno: ev.lineno, Construct: "include"})
+	defer func() {
+		ev.includeStack = ev.includeStack[:len(ev.includeStack)-1]
+	}()
+
 	for _, stmt := range mk.stmts {
 		ev.eval(stmt)
 	}
@@ -317,6 +543,7 @@ func (ev *Evaluator) updateReadMakefile(fn string, c []byte, st int32) {
 }
 
 func (ev *Evaluator) evalInclude(ast *IncludeAST) {
+	defer theTracer.begin("evalInclude", ast.filename, ast.lineno)()
 	ev.lastRule = nil
 	ev.filename = ast.filename
 	ev.lineno = ast.lineno
@@ -324,10 +551,10 @@ func (ev *Evaluator) evalInclude(ast *IncludeAST) {
 	Log("%s:%d include %q", ev.filename, ev.lineno, ast.expr)
 	v, _, err := parseExpr([]byte(ast.expr), nil)
 	if err != nil {
-		panic(err)
+		panic(ev.errorf("include", "%v", err))
 	}
 	var buf bytes.Buffer
-	v.Eval(&buf, ev)
+	ev.evalTraced(&buf, v)
 	pats := splitSpaces(buf.String())
 	buf.Reset()
 
@@ -336,7 +563,7 @@ func (ev *Evaluator) evalInclude(ast *IncludeAST) {
 		if strings.Contains(pat, "*") || strings.Contains(pat, "?") {
 			matched, err := filepath.Glob(pat)
 			if err != nil {
-				panic(err)
+				panic(ev.errorf("include", "%v", err))
 			}
 			files = append(files, matched...)
 		} else {
@@ -344,11 +571,37 @@ func (ev *Evaluator) evalInclude(ast *IncludeAST) {
 		}
 	}
 
+	// Prefetch only the files the sequential loop below will actually
+	// read: skip any that the ignoreOptionalInclude filter will skip, so
+	// the worker pool's capacity isn't spent on files guaranteed not to
+	// be used.
+	for _, fn := range files {
+		if ignoreOptionalInclude != "" && ast.op == "-include" && strings.HasPrefix(fn, ignoreOptionalInclude) {
+			continue
+		}
+		ev.prefetcher.schedule(fn)
+	}
+
 	for _, fn := range files {
 		if ignoreOptionalInclude != "" && ast.op == "-include" && strings.HasPrefix(fn, ignoreOptionalInclude) {
 			continue
 		}
-		c, err := ioutil.ReadFile(fn)
+		// An earlier file of this same statement left ev.filename/ev.lineno
+		// at its own last statement; point them back at this include.
+		ev.filename = ast.filename
+		ev.lineno = ast.lineno
+		// A prefetch hit already did the read (and, if lucky, the
+		// parse): reuse its bytes instead of reading fn a second time,
+		// and hash those same bytes below so updateReadMakefile can
+		// never disagree with what evalIncludeFile actually evaluates.
+		pr, havePrefetch := ev.prefetcher.take(fn)
+		var c []byte
+		var err error
+		if havePrefetch {
+			c = pr.c
+		} else {
+			c, err = ioutil.ReadFile(fn)
+		}
 		if err != nil {
 			if ast.op == "include" {
 				Error(ev.filename, ev.lineno, fmt.Sprintf("%v\nNOTE: kati does not support generating missing makefiles", err))
@@ -358,26 +611,29 @@ func (ev *Evaluator) evalInclude(ast *IncludeAST) {
 			}
 		}
 		ev.updateReadMakefile(fn, c, FILE_EXISTS)
-		err = ev.evalIncludeFile(fn, c)
+		err = ev.evalIncludeFile(fn, c, pr, havePrefetch)
 		if err != nil {
-			panic(err)
+			panic(ev.errorf("include", "%v", err))
 		}
 	}
 }
 
 func (ev *Evaluator) evalIf(ast *IfAST) {
+	ev.filename = ast.filename
+	ev.lineno = ast.lineno
+
 	var isTrue bool
 	switch ast.op {
 	case "ifdef", "ifndef":
 		expr, _, err := parseExpr([]byte(ast.lhs), nil)
 		if err != nil {
-			panic(fmt.Errorf("ifdef parse %s:%d %v", ast.filename, ast.lineno, err))
+			panic(ev.errorf("if", "%s parse error: %v", ast.op, err))
 		}
 		buf := newBuf()
-		expr.Eval(buf, ev)
+		ev.evalTraced(buf, expr)
 		v := ev.LookupVar(buf.String())
 		buf.Reset()
-		v.Eval(buf, ev)
+		ev.evalTraced(buf, v)
 		value := buf.String()
 		val := buf.Len()
 		freeBuf(buf)
@@ -386,11 +642,11 @@ func (ev *Evaluator) evalIf(ast *IfAST) {
 	case "ifeq", "ifneq":
 		lexpr, _, err := parseExpr([]byte(ast.lhs), nil)
 		if err != nil {
-			panic(fmt.Errorf("ifeq lhs parse %s:%d %v", ast.filename, ast.lineno, err))
+			panic(ev.errorf("if", "%s lhs parse error: %v", ast.op, err))
 		}
 		rexpr, _, err := parseExpr([]byte(ast.rhs), nil)
 		if err != nil {
-			panic(fmt.Errorf("ifeq rhs parse %s:%d %v", ast.filename, ast.lineno, err))
+			panic(ev.errorf("if", "%s rhs parse error: %v", ast.op, err))
 		}
 		buf := newBuf()
 		params := ev.args(buf, lexpr, rexpr)
@@ -400,7 +656,7 @@ func (ev *Evaluator) evalIf(ast *IfAST) {
 		isTrue = (lhs == rhs) == (ast.op == "ifeq")
 		Log("%s lhs=%q %q rhs=%q %q => %t", ast.op, ast.lhs, lhs, ast.rhs, rhs, isTrue)
 	default:
-		panic(fmt.Sprintf("unknown if statement: %q", ast.op))
+		panic(ev.errorf("if", "unknown if statement: %q", ast.op))
 	}
 
 	var stmts []AST
@@ -424,7 +680,7 @@ func (ev *Evaluator) evalExport(ast *ExportAST) {
 		panic(err)
 	}
 	var buf bytes.Buffer
-	v.Eval(&buf, ev)
+	ev.evalTraced(&buf, v)
 	for _, n := range splitSpacesBytes(buf.Bytes()) {
 		ev.exports[string(n)] = ast.export
 	}
@@ -443,10 +699,28 @@ func createReadMakefileArray(mp map[string]*ReadMakefile) []*ReadMakefile {
 }
 
 func Eval(mk Makefile, vars Vars) (er *EvalResult, err error) {
+	initTracer()
 	ev := newEvaluator(vars)
+	defer ev.prefetcher.close()
+	defer func() {
+		if cerr := theTracer.Close(); cerr != nil {
+			Warn("", 0, "failed to write --trace_file: %v", cerr)
+		}
+	}()
 	defer func() {
-		if r := recover(); r != nil {
-			err = fmt.Errorf("panic in eval %s: %v", mk.filename, r)
+		r := recover()
+		if r == nil {
+			return
+		}
+		if ee, ok := r.(*evalError); ok {
+			err = ee
+			return
+		}
+		// A plain panic (not raised via ev.errorf) still gets the one
+		// frame we know about rather than kati's generic crash handler.
+		err = &evalError{
+			Frames: []evalFrame{{Filename: ev.filename, Lineno: ev.lineno, Construct: "eval"}},
+			Msg:    fmt.Sprintf("%v", r),
 		}
 	}()
 
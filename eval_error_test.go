@@ -0,0 +1,96 @@
+package main
+
+import "testing"
+
+func TestEvalErrorFormatsGCCStyleIncludeChain(t *testing.T) {
+	e := &evalError{
+		Frames: []evalFrame{
+			{Filename: "Android.mk", Lineno: 3, Construct: "include"},
+			{Filename: "build/core/config.mk", Lineno: 42, Construct: "include"},
+			{Filename: "build/core/product.mk", Lineno: 7, Construct: "assign"},
+		},
+		Msg: "*** empty variable name.",
+	}
+	want := "In file included from Android.mk:3:\n" +
+		"                 from build/core/config.mk:42:\n" +
+		"build/core/product.mk:7: *** empty variable name."
+	if got := e.Error(); got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
+
+func TestEvalErrorSingleFrameHasNoIncludedFromHeader(t *testing.T) {
+	e := &evalError{
+		Frames: []evalFrame{{Filename: "Android.mk", Lineno: 1, Construct: "assign"}},
+		Msg:    "*** empty variable name.",
+	}
+	want := "Android.mk:1: *** empty variable name."
+	if got := e.Error(); got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
+
+// TestIncludeParseFailureFrameIsNotDuplicated sets up, by hand, the state
+// evalInclude is in when the target file fails to read/parse: an
+// evalIncludeFile that only pushes its frame once fname has actually
+// parsed leaves ev.includeStack holding only this statement's ancestors,
+// not a frame for this statement itself, so errorf yields a single frame
+// rather than a second, identical one on top of it. It does not run
+// evalInclude itself.
+func TestIncludeParseFailureFrameIsNotDuplicated(t *testing.T) {
+	ev := newEvaluator(make(map[string]Var))
+	ev.filename = "Android.mk"
+	ev.lineno = 5
+
+	err := ev.errorf("include", "%v", "parse error")
+
+	if len(err.Frames) != 1 {
+		t.Fatalf("Frames = %v, want exactly one frame (no duplicate ancestor)", err.Frames)
+	}
+	want := "Android.mk:5: parse error"
+	if got := err.Error(); got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
+
+// TestNestedIncludeParseFailureHasOneFrameAtEachLevel simulates the deeper
+// case: Android.mk includes config.mk successfully, and config.mk's own
+// include of product.mk fails to parse. Once evalIncludeFile's push for
+// config.mk has happened (it parsed fine), a failure one level down should
+// add exactly one more frame, at product.mk's include site, not duplicate
+// config.mk's.
+func TestNestedIncludeParseFailureHasOneFrameAtEachLevel(t *testing.T) {
+	ev := newEvaluator(make(map[string]Var))
+	ev.filename = "Android.mk"
+	ev.lineno = 5
+	ev.includeStack = append(ev.includeStack, evalFrame{Filename: ev.filename, Lineno: ev.lineno, Construct: "include"})
+
+	ev.filename = "config.mk"
+	ev.lineno = 7
+
+	err := ev.errorf("include", "%v", "parse error")
+
+	if len(err.Frames) != 2 {
+		t.Fatalf("Frames = %v, want exactly two frames (one per level)", err.Frames)
+	}
+	want := "In file included from Android.mk:5:\n" +
+		"config.mk:7: parse error"
+	if got := err.Error(); got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
+
+func TestEvalErrorJSONMode(t *testing.T) {
+	*jsonDiagnostics = true
+	defer func() { *jsonDiagnostics = false }()
+
+	e := &evalError{
+		Frames: []evalFrame{{Filename: "Android.mk", Lineno: 1, Construct: "assign"}},
+		Msg:    "*** empty variable name.",
+	}
+	got := e.Error()
+	want := `{"stack":[{"file":"Android.mk","line":1,"construct":"assign"}],"message":"*** empty variable name."}`
+	if got != want {
+		t.Errorf("Error() (json mode) = %q, want %q", got, want)
+	}
+}
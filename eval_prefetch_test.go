@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestIncludePrefetcherTakeConsumesResultOnce(t *testing.T) {
+	p := newIncludePrefetcher(4)
+	if p == nil {
+		t.Fatal("newIncludePrefetcher(4) = nil, want a pool")
+	}
+	defer p.close()
+
+	p.mu.Lock()
+	p.results["foo.mk"] = prefetchResult{mk: Makefile{filename: "foo.mk"}}
+	p.mu.Unlock()
+
+	got, ok := p.take("foo.mk")
+	if !ok || got.mk.filename != "foo.mk" {
+		t.Fatalf("take(%q) = %+v, %v; want a hit for foo.mk", "foo.mk", got, ok)
+	}
+	if _, ok := p.take("foo.mk"); ok {
+		t.Fatal("take() should consume the result; a second call should miss")
+	}
+}
+
+// TestIncludePrefetcherConcurrentParsesDontRace runs several prefetch
+// workers parsing distinct files alongside a ParseMakefile call on a
+// separate goroutine, so `go test -race` can catch a data race in
+// ParseMakefile's own internals (buffer pools, interning tables, stats
+// counters) if concurrent calls into it aren't actually safe - something
+// this package's own locking can't guarantee on its own.
+func TestIncludePrefetcherConcurrentParsesDontRace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kati-prefetch-race-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const n = 8
+	var files []string
+	for i := 0; i < n; i++ {
+		fn := filepath.Join(dir, fmt.Sprintf("%d.mk", i))
+		if err := ioutil.WriteFile(fn, []byte(fmt.Sprintf("VAR%d := %d\n", i, i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, fn)
+	}
+	mainFile := filepath.Join(dir, "main.mk")
+	if err := ioutil.WriteFile(mainFile, []byte("MAIN := 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := newIncludePrefetcher(4)
+	if p == nil {
+		t.Fatal("newIncludePrefetcher(4) = nil, want a pool")
+	}
+	defer p.close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c, err := ioutil.ReadFile(mainFile)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if _, err := ParseMakefile(c, mainFile); err != nil {
+			t.Errorf("ParseMakefile(%q) = %v, want nil", mainFile, err)
+		}
+	}()
+
+	for _, fn := range files {
+		p.schedule(fn)
+	}
+	for _, fn := range files {
+		for {
+			if _, ok := p.take(fn); ok {
+				break
+			}
+			runtime.Gosched()
+		}
+	}
+	wg.Wait()
+}
+
+func TestIncludePrefetcherDisabledForSingleWorker(t *testing.T) {
+	if p := newIncludePrefetcher(1); p != nil {
+		t.Fatalf("newIncludePrefetcher(1) = %v, want nil (prefetching disabled)", p)
+	}
+	if p := newIncludePrefetcher(0); p != nil {
+		t.Fatalf("newIncludePrefetcher(0) = %v, want nil (prefetching disabled)", p)
+	}
+}
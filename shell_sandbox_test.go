@@ -0,0 +1,81 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestManifestKeyMatchesRegardlessOfEnvOrder(t *testing.T) {
+	k1 := manifestKey("echo hi", []string{"A=1", "B=2"})
+	k2 := manifestKey("echo hi", []string{"B=2", "A=1"})
+	if k1 != k2 {
+		t.Errorf("manifestKey should be order-independent in env: %q != %q", k1, k2)
+	}
+	if k3 := manifestKey("echo hi", []string{"A=1"}); k3 == k1 {
+		t.Error("manifestKey should depend on the env it's given")
+	}
+	if k4 := manifestKey("echo bye", []string{"A=1", "B=2"}); k4 == k1 {
+		t.Error("manifestKey should depend on the command")
+	}
+}
+
+func TestShellSandboxReplayRoundTrip(t *testing.T) {
+	sb := &shellSandbox{
+		replay:  true,
+		entries: make(map[string]shellManifestEntry),
+	}
+	cmd := "echo hi"
+	env := []string{"FOO=bar"}
+	sb.entries[manifestKey(cmd, env)] = shellManifestEntry{
+		Cmd:    cmd,
+		Env:    env,
+		Stdout: "hi\n",
+	}
+
+	out, ok := sb.Replay(cmd, env)
+	if !ok || string(out) != "hi\n" {
+		t.Fatalf("Replay(%q, %v) = %q, %v; want \"hi\\n\", true", cmd, env, out, ok)
+	}
+
+	if _, ok := sb.Replay("echo bye", env); ok {
+		t.Error("Replay should miss for a command that was never recorded")
+	}
+}
+
+func TestShellSandboxCheckAllowlist(t *testing.T) {
+	sb := newShellSandboxForTest(t, []string{"^echo "})
+
+	if err := sb.Check("echo hi"); err != nil {
+		t.Errorf("Check(%q) = %v, want nil", "echo hi", err)
+	}
+	if err := sb.Check("rm -rf /"); err == nil {
+		t.Error("Check(\"rm -rf /\") = nil, want an error (not on the allowlist)")
+	}
+}
+
+func TestShellReplayMissingManifest(t *testing.T) {
+	cases := []struct {
+		replay       bool
+		manifestPath string
+		want         bool
+	}{
+		{replay: true, manifestPath: "", want: true},
+		{replay: true, manifestPath: "manifest.json", want: false},
+		{replay: false, manifestPath: "", want: false},
+		{replay: false, manifestPath: "manifest.json", want: false},
+	}
+	for _, c := range cases {
+		if got := shellReplayMissingManifest(c.replay, c.manifestPath); got != c.want {
+			t.Errorf("shellReplayMissingManifest(%v, %q) = %v, want %v", c.replay, c.manifestPath, got, c.want)
+		}
+	}
+}
+
+func newShellSandboxForTest(t *testing.T, allowPatterns []string) *shellSandbox {
+	t.Helper()
+	sb := &shellSandbox{entries: make(map[string]shellManifestEntry)}
+	for _, pat := range allowPatterns {
+		sb.allow = append(sb.allow, regexp.MustCompile(pat))
+	}
+	return sb
+}
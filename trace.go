@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var traceFile = flag.String("trace_file", "", "Write a chrome://tracing-compatible JSON trace of evaluation to this file.")
+
+// traceEvent is one entry of the Chrome Trace Event Format
+// (https://chromium.googlesource.com/catapult, trace-viewer). kati only
+// emits the subset it needs: paired B(egin)/E(nd) duration events on a
+// single thread, with filename:lineno stashed in args for readers that
+// want to jump to source.
+type traceEvent struct {
+	Name string            `json:"name"`
+	Ph   string            `json:"ph"`
+	Ts   int64             `json:"ts"`
+	Pid  int               `json:"pid"`
+	Tid  int               `json:"tid"`
+	Args map[string]string `json:"args,omitempty"`
+}
+
+// tracer collects traceEvents and writes them out as a JSON array on
+// Close. It is nil (and all its methods are no-ops) unless --trace_file is
+// set, so instrumentation call sites don't need their own nil checks
+// beyond going through this type.
+type tracer struct {
+	mu     sync.Mutex
+	start  time.Time
+	events []traceEvent
+	path   string
+}
+
+var (
+	theTracer     *tracer
+	initTracerOne sync.Once
+)
+
+func initTracer() {
+	initTracerOne.Do(func() {
+		if *traceFile == "" {
+			return
+		}
+		theTracer = &tracer{
+			start: time.Now(),
+			path:  *traceFile,
+		}
+	})
+}
+
+// begin records a B event for name at filename:lineno and returns a
+// closure that records the matching E event. Typical use:
+//   defer theTracer.begin("evalInclude", filename, lineno)()
+func (t *tracer) begin(name, filename string, lineno int) func() {
+	if t == nil {
+		return func() {}
+	}
+	t.emit(name, "B", filename, lineno)
+	return func() {
+		t.emit(name, "E", filename, lineno)
+	}
+}
+
+func (t *tracer) emit(name, ph, filename string, lineno int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ev := traceEvent{
+		Name: name,
+		Ph:   ph,
+		Ts:   time.Since(t.start).Microseconds(),
+		Pid:  1,
+		Tid:  1,
+	}
+	if filename != "" {
+		ev.Args = map[string]string{"loc": filename + ":" + strconv.Itoa(lineno)}
+	}
+	t.events = append(t.events, ev)
+}
+
+// traceFuncName derives a trace event name for a Value being evaluated,
+// e.g. "*main.funcStrip" for $(strip ...). Used to label the B/E pair around
+// each funcXxx.Eval call without every func type needing its own tracer
+// hook.
+func traceFuncName(v Value) string {
+	return fmt.Sprintf("%T", v)
+}
+
+// Close flushes the collected events to --trace_file as a JSON array.
+func (t *tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, err := os.Create(t.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(t.events)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// TestEvalTracedEmitsNamedBEPairForRealFunction guards against the trace
+// only covering ev.args (function arguments), not the function call
+// itself: evalTraced is the call site evalAssignAST/evalInclude/evalIf
+// use for values evaluated directly rather than as another function's
+// argument, and a slow $(shell ...)/$(eval ...) only shows up in
+// --trace_file if that site is actually instrumented.
+func TestEvalTracedEmitsNamedBEPairForRealFunction(t *testing.T) {
+	theTracer = &tracer{start: time.Now()}
+	defer func() { theTracer = nil }()
+
+	ev := newEvaluator(make(map[string]Var))
+	ev.filename = "Android.mk"
+	ev.lineno = 9
+
+	strip := &funcStrip{
+		fclosure: fclosure{
+			args: []Value{
+				literal("(strip"),
+				literal(" a b  c "),
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	ev.evalTraced(&buf, strip)
+
+	if len(theTracer.events) != 2 {
+		t.Fatalf("events = %+v, want 2 (a B/E pair)", theTracer.events)
+	}
+	b, e := theTracer.events[0], theTracer.events[1]
+	const wantName = "*main.funcStrip"
+	if b.Name != wantName || b.Ph != "B" {
+		t.Errorf("begin event = %+v, want name %q ph \"B\"", b, wantName)
+	}
+	if e.Name != wantName || e.Ph != "E" {
+		t.Errorf("end event = %+v, want name %q ph \"E\"", e, wantName)
+	}
+	if b.Args["loc"] != "Android.mk:9" || e.Args["loc"] != "Android.mk:9" {
+		t.Errorf("events should carry ev's current filename:lineno, got begin=%q end=%q", b.Args["loc"], e.Args["loc"])
+	}
+}
+
+func TestEvalTracedNoopWithoutTraceFile(t *testing.T) {
+	theTracer = nil
+
+	ev := newEvaluator(make(map[string]Var))
+	var buf bytes.Buffer
+	// Must not panic when no --trace_file is configured.
+	ev.evalTraced(&buf, literal("hi"))
+	if buf.String() != "hi" {
+		t.Errorf("buf = %q, want %q", buf.String(), "hi")
+	}
+}